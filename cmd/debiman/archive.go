@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/exp/mmap"
+)
+
+var packArchive = flag.String("pack_archive",
+	"",
+	"if non-empty, instead of writing one precompressed file per manpage into -serving_dir, "+
+		"pack every rendered artifact into a single sealed archive at this path (htpack-style). "+
+		"Serving binaries should use OpenArchive to mmap and serve it directly")
+
+// archiveEncoding locates one encoded copy of an artifact within the sealed
+// archive file.
+type archiveEncoding struct {
+	Offset int64
+	Length int64
+	SHA256 [sha256.Size]byte
+}
+
+// archiveEntry is the per-artifact record stored in the archive's index,
+// keyed by the path the artifact would have had under -serving_dir (e.g.
+// "stretch/coreutils/dos2unix.1.en.html").
+type archiveEntry struct {
+	Path      string
+	Encodings map[string]archiveEncoding // extension ("gz", "br", "zst") → location
+}
+
+// archiveWriter appends artifacts to a single content-addressed archive
+// file, used instead of per-artifact files when -pack_archive is set. One
+// archiveWriter is shared by all renderAll workers, so all exported methods
+// are safe for concurrent use.
+type archiveWriter struct {
+	mu      sync.Mutex
+	f       *os.File
+	offset  int64
+	entries []archiveEntry
+	dest    string
+}
+
+// newArchiveWriter creates a temporary file alongside dest to accumulate
+// artifacts into; call Seal to atomically publish it at dest.
+func newArchiveWriter(dest string) (*archiveWriter, error) {
+	f, err := ioutil.TempFile(filepath.Dir(dest), "debiman-archive-")
+	if err != nil {
+		return nil, err
+	}
+	return &archiveWriter{f: f, dest: dest}, nil
+}
+
+// add encodes content with every currently enabled encoding (gzip via zopfli
+// when the zopfli binary is installed, else compress/gzip, see
+// encodeForArchive), via the shared
+// CPU-bound compress pool (see compressAllForArchive), and appends each
+// encoded copy to the archive, recording its location in the index.
+//
+// Encoding happens before a.mu is acquired: it is the expensive step (zopfli
+// in particular shells out to an external process), and multiple renderAll
+// workers call add concurrently, so serializing them on the lock for the
+// whole call would defeat that parallelism. The lock only guards the file
+// writes and index bookkeeping, which must stay in order with a.offset.
+//
+// All of content's encodings are dispatched to the pool up front and
+// awaited together, rather than one at a time, so a single artifact's
+// gz/br/zst encoding runs with real concurrency instead of serializing on
+// the slowest of the three (zopfli in particular).
+func (a *archiveWriter) add(path string, content []byte) error {
+	exts := encodingExtensions()
+	encoded, err := compressAllForArchive(content)
+	if err != nil {
+		return err
+	}
+
+	entry := archiveEntry{
+		Path:      path,
+		Encodings: make(map[string]archiveEncoding, len(exts)),
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, ext := range exts {
+		enc := encoded[ext]
+
+		if _, err := a.f.Write(enc); err != nil {
+			return err
+		}
+
+		entry.Encodings[ext] = archiveEncoding{
+			Offset: a.offset,
+			Length: int64(len(enc)),
+			SHA256: sha256.Sum256(enc),
+		}
+		a.offset += int64(len(enc))
+	}
+
+	a.entries = append(a.entries, entry)
+	return nil
+}
+
+// encodeForArchive encodes content with the given extension, using zopfli
+// (if the zopfli binary is available) instead of compress/gzip for the "gz"
+// encoding: archive artifacts are compressed once and served forever, so the
+// extra zopfli CPU cost (far above gzip.BestCompression) is worth paying.
+func encodeForArchive(content []byte, ext string) ([]byte, error) {
+	if ext == "gz" {
+		if encoded, err := compressGzipZopfli(content); err == nil {
+			return encoded, nil
+		}
+		// zopfli binary not installed: fall back to compress/gzip.
+	}
+
+	var buf bytes.Buffer
+	enc, err := newEncoder(&buf, ext)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := enc.Write(content); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compressGzipZopfli shells out to the zopfli binary, which produces
+// smaller (but much slower to generate) gzip streams than
+// compress/gzip.BestCompression. It returns an error if zopfli is not
+// installed.
+func compressGzipZopfli(content []byte) ([]byte, error) {
+	path, err := exec.LookPath("zopfli")
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path, "--gzip", "-c", "--i15") // 15 iterations, the same as zopfli's default
+	cmd.Stdin = bytes.NewReader(content)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("zopfli: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// archiveMagic identifies the trailer format; archiveTrailerLen is the
+// fixed, known-in-advance size of the footer so that OpenArchive can locate
+// it with a single ReadAt at the end of the file, without scanning.
+const archiveMagic = "debiman-archive-v1\n"
+
+var archiveTrailerLen = int64(8 + 8 + len(archiveMagic))
+
+// Seal writes the gob-encoded index followed by a fixed-size trailer
+// (index offset, index length, magic), flushes the archive to disk and
+// atomically renames it into place at the destination passed to
+// newArchiveWriter. No further calls to add are permitted afterwards.
+func (a *archiveWriter) Seal() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	indexOffset := a.offset
+	var indexBuf bytes.Buffer
+	if err := gob.NewEncoder(&indexBuf).Encode(a.entries); err != nil {
+		return err
+	}
+	if _, err := a.f.Write(indexBuf.Bytes()); err != nil {
+		return err
+	}
+
+	trailer := make([]byte, archiveTrailerLen)
+	binary.BigEndian.PutUint64(trailer[0:8], uint64(indexOffset))
+	binary.BigEndian.PutUint64(trailer[8:16], uint64(indexBuf.Len()))
+	copy(trailer[16:], archiveMagic)
+	if _, err := a.f.Write(trailer); err != nil {
+		return err
+	}
+
+	if err := a.f.Sync(); err != nil {
+		return err
+	}
+	if err := a.f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(a.f.Name(), a.dest)
+}
+
+// Archive is a sealed artifact archive opened for serving: the whole file
+// is mmap’d, so lookups involve no syscalls beyond the initial open.
+//
+// This repository only renders; it does not contain an HTTP serving
+// binary. Archive/OpenArchive/Lookup are the building blocks a separate
+// serving process would import and call per request (mmap the archive once
+// at startup, then Lookup+write the returned bytes for each request);
+// nothing in this tree currently does so.
+type Archive struct {
+	r     *mmap.ReaderAt
+	index map[string]archiveEntry
+}
+
+// OpenArchive mmaps the archive at path and decodes its index, ready for
+// Lookup calls from a serving process's request handler (see the Archive
+// doc comment: that process lives outside this repository).
+func OpenArchive(path string) (*Archive, error) {
+	r, err := mmap.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	trailer := make([]byte, archiveTrailerLen)
+	if _, err := r.ReadAt(trailer, int64(r.Len())-archiveTrailerLen); err != nil {
+		r.Close()
+		return nil, err
+	}
+	if string(trailer[16:]) != archiveMagic {
+		r.Close()
+		return nil, fmt.Errorf("OpenArchive: %s: missing %q trailer, not a debiman archive", path, archiveMagic)
+	}
+	indexOffset := int64(binary.BigEndian.Uint64(trailer[0:8]))
+	indexLength := int64(binary.BigEndian.Uint64(trailer[8:16]))
+
+	indexBuf := make([]byte, indexLength)
+	if _, err := r.ReadAt(indexBuf, indexOffset); err != nil {
+		r.Close()
+		return nil, err
+	}
+	var entries []archiveEntry
+	if err := gob.NewDecoder(bytes.NewReader(indexBuf)).Decode(&entries); err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	index := make(map[string]archiveEntry, len(entries))
+	for _, e := range entries {
+		index[e.Path] = e
+	}
+
+	return &Archive{r: r, index: index}, nil
+}
+
+// Lookup returns the bytes and Content-Encoding token of the rendered
+// artifact at servingPath, preferring the strongest encoding the client
+// announced via acceptEncoding (an HTTP Accept-Encoding header value).
+func (a *Archive) Lookup(servingPath, acceptEncoding string) (content []byte, httpEncoding string, ok bool) {
+	entry, found := a.index[servingPath]
+	if !found {
+		return nil, "", false
+	}
+
+	ext := acceptedEncoding(acceptEncoding)
+	loc, found := entry.Encodings[ext]
+	if !found {
+		// The preferred encoding was not packed for this artifact (e.g. it
+		// predates enabling -enable_zstd); gzip is always present.
+		ext = "gz"
+		loc = entry.Encodings[ext]
+	}
+
+	buf := make([]byte, loc.Length)
+	if _, err := a.r.ReadAt(buf, loc.Offset); err != nil {
+		return nil, "", false
+	}
+	for _, e := range httpEncodingNames {
+		if e.ext == ext {
+			return buf, e.header, true
+		}
+	}
+	return buf, "", true
+}
+
+// Close unmaps the archive.
+func (a *Archive) Close() error {
+	return a.r.Close()
+}
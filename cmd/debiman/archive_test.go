@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveSealOpenLookupRoundTrip(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "site.archive")
+
+	aw, err := newArchiveWriter(dest)
+	if err != nil {
+		t.Fatalf("newArchiveWriter: %v", err)
+	}
+
+	pages := map[string][]byte{
+		"stretch/coreutils/dos2unix.1.en.html": []byte("<html>dos2unix</html>"),
+		"stretch/bash/bash.1.en.html":          []byte("<html>bash</html>"),
+	}
+	for path, content := range pages {
+		if err := aw.add(path, content); err != nil {
+			t.Fatalf("add(%q): %v", path, err)
+		}
+	}
+	if err := aw.Seal(); err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	a, err := OpenArchive(dest)
+	if err != nil {
+		t.Fatalf("OpenArchive: %v", err)
+	}
+	defer a.Close()
+
+	for path, want := range pages {
+		content, enc, ok := a.Lookup(path, "gzip")
+		if !ok {
+			t.Fatalf("Lookup(%q) not found", path)
+		}
+		if enc != "gzip" {
+			t.Fatalf("Lookup(%q) encoding = %q, want %q", path, enc, "gzip")
+		}
+		got, err := gunzip(content)
+		if err != nil {
+			t.Fatalf("gunzip(%q): %v", path, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Lookup(%q) content = %q, want %q", path, got, want)
+		}
+	}
+
+	if _, _, ok := a.Lookup("no/such/page.html", "gzip"); ok {
+		t.Error("Lookup of a path never added to the archive should not be found")
+	}
+}
+
+func TestArchiveLookupFallsBackToGzip(t *testing.T) {
+	// Without -enable_brotli/-enable_zstd, the archive only ever contains
+	// gz encodings; a client asking for br/zstd must still get gz back.
+	dest := filepath.Join(t.TempDir(), "site.archive")
+	aw, err := newArchiveWriter(dest)
+	if err != nil {
+		t.Fatalf("newArchiveWriter: %v", err)
+	}
+	want := []byte("<html>only gz here</html>")
+	if err := aw.add("a.html", want); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := aw.Seal(); err != nil {
+		t.Fatalf("Seal: %v", err)
+	}
+
+	a, err := OpenArchive(dest)
+	if err != nil {
+		t.Fatalf("OpenArchive: %v", err)
+	}
+	defer a.Close()
+
+	content, enc, ok := a.Lookup("a.html", "br, zstd")
+	if !ok {
+		t.Fatal("Lookup not found")
+	}
+	if enc != "gzip" {
+		t.Errorf("encoding = %q, want fallback to %q", enc, "gzip")
+	}
+	got, err := gunzip(content)
+	if err != nil {
+		t.Fatalf("gunzip: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("content = %q, want %q", got, want)
+	}
+}
+
+func gunzip(b []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
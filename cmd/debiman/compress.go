@@ -0,0 +1,169 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	enableBrotli = flag.Bool("enable_brotli",
+		false,
+		"also write a .br (Brotli) copy of every rendered artifact, in addition to .gz")
+
+	enableZstd = flag.Bool("enable_zstd",
+		false,
+		"also write a .zst (Zstandard) copy of every rendered artifact, in addition to .gz")
+)
+
+// encodingExtensions returns the file extensions (without the leading dot)
+// of all encodings that are currently enabled, in the fixed order gz, br,
+// zst. This is not the content negotiation preference order, which is
+// defined by httpEncodingNames. gzip is always included, as it is the
+// baseline format every HTTP client understands.
+func encodingExtensions() []string {
+	exts := []string{"gz"}
+	if *enableBrotli {
+		exts = append(exts, "br")
+	}
+	if *enableZstd {
+		exts = append(exts, "zst")
+	}
+	return exts
+}
+
+// withEncodingExt returns the sibling path of gzDest (which must end in
+// ".gz") for the specified extension, e.g. withEncodingExt("foo.html.gz",
+// "br") returns "foo.html.br".
+func withEncodingExt(gzDest, ext string) string {
+	if ext == "gz" {
+		return gzDest
+	}
+	return strings.TrimSuffix(gzDest, ".gz") + "." + ext
+}
+
+// newEncoder wraps w with a compressing io.WriteCloser for the specified
+// extension ("gz", "br" or "zst"), each configured for maximum compression:
+// the resulting artifacts are written once and served many times, so it pays
+// off to spend the CPU time upfront.
+func newEncoder(w io.Writer, ext string) (io.WriteCloser, error) {
+	switch ext {
+	case "gz":
+		// NOTE(stapelberg): gzip’s decompression phase takes the same
+		// time, regardless of compression level. Hence, we invest the
+		// maximum CPU time once to achieve the best compression.
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	case "br":
+		return brotli.NewWriterLevel(w, brotli.BestCompression), nil
+	case "zst":
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	default:
+		return nil, fmt.Errorf("newEncoder: unknown encoding %q", ext)
+	}
+}
+
+// httpEncodingNames maps our on-disk extensions to the tokens used in the
+// HTTP Accept-Encoding / Content-Encoding headers, in preference order
+// (strongest compression first).
+var httpEncodingNames = []struct{ ext, header string }{
+	{"zst", "zstd"},
+	{"br", "br"},
+	{"gz", "gzip"},
+}
+
+// acceptedEncoding picks the best encoding (one of encodingExtensions())
+// that the client sent in an Accept-Encoding header, preferring the
+// strongest compression available, falling back to "gz" (which is always
+// present) when the client announced no supported encoding. It is a
+// building block for a serving process's request handler (see lookupEncoded
+// and Archive.Lookup); this repository only renders and does not itself
+// contain such a process.
+func acceptedEncoding(acceptEncoding string) string {
+	offered := make(map[string]bool)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		// Accept-Encoding entries may carry a ";q=" weight, e.g. "br;q=1.0".
+		// A weight of exactly 0 means the client explicitly refuses that
+		// encoding (RFC 7231 section 5.3.1), so it must not be offered;
+		// any other (or absent) weight is treated as supported, which is
+		// enough to pick the preferred encoding debiman offers.
+		fields := strings.SplitN(part, ";", 2)
+		name := strings.TrimSpace(fields[0])
+		q := 1.0
+		if len(fields) == 2 {
+			if v, ok := parseQValue(fields[1]); ok {
+				q = v
+			}
+		}
+		if name != "" && q > 0 {
+			offered[name] = true
+		}
+	}
+	enabled := make(map[string]bool)
+	for _, ext := range encodingExtensions() {
+		enabled[ext] = true
+	}
+	for _, e := range httpEncodingNames {
+		if offered[e.header] && enabled[e.ext] {
+			return e.ext
+		}
+	}
+	return "gz"
+}
+
+// parseQValue extracts the weight from an Accept-Encoding parameter such as
+// "q=0" or "q=0.8", returning ok=false if param does not carry a usable
+// "q=" weight (in which case the caller should treat the encoding as
+// supported, per RFC 7231's default weight of 1).
+func parseQValue(param string) (q float64, ok bool) {
+	param = strings.TrimSpace(param)
+	if !strings.HasPrefix(param, "q=") {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// lookupEncoded picks the best available precompressed sibling of the
+// artifact at servingPath (the path writeAtomically rendered to, without an
+// encoding extension, e.g. ".../dos2unix.1.en.html") for a client's
+// Accept-Encoding header, and reads it. It is the per-file-serving
+// counterpart of Archive.Lookup, for the default backend (i.e. when
+// -pack_archive is not in use): a serving process would call this per
+// request to decide which sibling to send and under what Content-Encoding.
+// As with Archive.Lookup, that process is a separate, out-of-repository
+// component; nothing in this tree calls lookupEncoded.
+func lookupEncoded(servingPath, acceptEncoding string) (content []byte, httpEncoding string, err error) {
+	tryExts := []string{acceptedEncoding(acceptEncoding)}
+	if tryExts[0] != "gz" {
+		// The client's preferred encoding may not have been enabled when
+		// the site was rendered; gz is always written, so fall back to it.
+		tryExts = append(tryExts, "gz")
+	}
+
+	gzDest := servingPath + ".gz"
+	var lastErr error
+	for _, ext := range tryExts {
+		content, err := ioutil.ReadFile(withEncodingExt(gzDest, ext))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, e := range httpEncodingNames {
+			if e.ext == ext {
+				return content, e.header, nil
+			}
+		}
+		return content, "", nil
+	}
+	return nil, "", lastErr
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseQValue(t *testing.T) {
+	tests := []struct {
+		param  string
+		wantQ  float64
+		wantOK bool
+	}{
+		{"q=0", 0, true},
+		{"q=0.0", 0, true},
+		{"q=1", 1, true},
+		{"q=0.8", 0.8, true},
+		{" q=0.8 ", 0.8, true},
+		{"charset=utf-8", 0, false},
+		{"q=bogus", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		q, ok := parseQValue(tt.param)
+		if ok != tt.wantOK || (ok && q != tt.wantQ) {
+			t.Errorf("parseQValue(%q) = (%v, %v), want (%v, %v)", tt.param, q, ok, tt.wantQ, tt.wantOK)
+		}
+	}
+}
+
+func TestAcceptedEncoding(t *testing.T) {
+	*enableBrotli = true
+	*enableZstd = true
+	defer func() {
+		*enableBrotli = false
+		*enableZstd = false
+	}()
+
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", "gz"},
+		{"gzip", "gz"},
+		{"gzip, br, zstd", "zst"},
+		{"gzip, br", "br"},
+		// A q=0 entry is an explicit refusal (RFC 7231 5.3.1), so the next
+		// best offered encoding must be picked instead.
+		{"zstd;q=0, br;q=1.0, gzip", "br"},
+		{"zstd;q=0, br;q=0, gzip", "gz"},
+		// Absent or non-zero weights are all treated as "supported".
+		{"zstd;q=0.1", "zst"},
+	}
+	for _, tt := range tests {
+		if got := acceptedEncoding(tt.acceptEncoding); got != tt.want {
+			t.Errorf("acceptedEncoding(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestAcceptedEncodingOnlyGzipEnabled(t *testing.T) {
+	// *enableBrotli/*enableZstd default to false: even a client offering
+	// every encoding must fall back to gz if nothing else was enabled when
+	// the site was rendered.
+	if got := acceptedEncoding("gzip, br, zstd"); got != "gz" {
+		t.Errorf("acceptedEncoding with no optional encodings enabled = %q, want %q", got, "gz")
+	}
+}
+
+func TestLookupEncoded(t *testing.T) {
+	*enableBrotli = true
+	defer func() { *enableBrotli = false }()
+
+	dir := t.TempDir()
+	servingPath := filepath.Join(dir, "dos2unix.1.en.html")
+
+	if err := ioutil.WriteFile(servingPath+".gz", []byte("gzip-bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(servingPath+".br", []byte("brotli-bytes"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	content, enc, err := lookupEncoded(servingPath, "br, gzip")
+	if err != nil {
+		t.Fatalf("lookupEncoded: %v", err)
+	}
+	if enc != "br" || string(content) != "brotli-bytes" {
+		t.Errorf("lookupEncoded returned (%q, %q), want (%q, %q)", content, enc, "brotli-bytes", "br")
+	}
+
+	// zstd was never enabled, so no .zst sibling exists: lookupEncoded must
+	// fall back to gz rather than erroring out.
+	content, enc, err = lookupEncoded(servingPath, "zstd")
+	if err != nil {
+		t.Fatalf("lookupEncoded fallback: %v", err)
+	}
+	if enc != "gzip" || string(content) != "gzip-bytes" {
+		t.Errorf("lookupEncoded fallback returned (%q, %q), want (%q, %q)", content, enc, "gzip-bytes", "gzip")
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/Debian/debiman/internal/manpage"
+)
+
+// manifestFilename is the name of the persistent manifest gob file kept at
+// the root of -serving_dir. It replaces repeatedly stat’ing every rendered
+// artifact to decide what is stale.
+const manifestFilename = ".debiman-manifest.gob"
+
+// manifestEntry records the inputs that produced one rendered artifact, so
+// that a subsequent run can tell whether it is still up to date without
+// re-rendering it. "Source" is deliberately generic: for a manpage it is the
+// hash of the source .gz content; for a package index or contents page it is
+// a hash summarizing the set of manpages/binary packages it was built from.
+type manifestEntry struct {
+	SourceHash   [sha256.Size]byte
+	XrefHash     [sha256.Size]byte
+	TemplateHash [sha256.Size]byte
+	// EncodingHash summarizes the set of encodings (see encodingExtensions)
+	// that were enabled when this artifact was last rendered, so that
+	// enabling -enable_brotli/-enable_zstd on an already-rendered
+	// -serving_dir is itself enough to invalidate every entry and produce
+	// the missing .br/.zst siblings.
+	EncodingHash [sha256.Size]byte
+	// BackendHash summarizes whether this entry was produced by the
+	// default per-file backend or by -pack_archive (see backendHash),
+	// which writes no per-file sibling at all (writeAtomically returns
+	// before reaching compressAll). Without this, an entry recorded while
+	// -pack_archive was set would look up to date to a later run without
+	// it, and that run would skip writing the per-file artifact forever.
+	BackendHash  [sha256.Size]byte
+	OutputDigest [sha256.Size]byte
+}
+
+// manifest is the persistent, gob-encoded record of manifestEntry keyed by
+// the artifact's path relative to -serving_dir (e.g.
+// "stretch/coreutils/dos2unix.1.en.html.gz"). All methods are safe for
+// concurrent use, since renderAll's worker pool looks up and updates entries
+// from multiple goroutines.
+type manifest struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]manifestEntry
+}
+
+// loadManifest reads the manifest at path, or returns an empty manifest if
+// it does not exist yet (e.g. the very first run against a -serving_dir).
+func loadManifest(path string) (*manifest, error) {
+	m := &manifest{path: path, entries: make(map[string]manifestEntry)}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(&m.entries); err != nil {
+		return nil, fmt.Errorf("loadManifest(%q): %v", path, err)
+	}
+	return m, nil
+}
+
+// lookup returns the previously recorded entry for artifact, if any.
+func (m *manifest) lookup(artifact string) (manifestEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.entries[artifact]
+	return e, ok
+}
+
+// update records (or replaces) the entry for artifact.
+func (m *manifest) update(artifact string, e manifestEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entries[artifact] = e
+}
+
+// stale reports whether artifact needs to be (re-)rendered, i.e. there is no
+// recorded entry yet or any of the hashes that went into it changed.
+// encodingHash must be encodingSetHash(), so that flipping -enable_brotli or
+// -enable_zstd on an already-rendered -serving_dir is itself enough to
+// invalidate every entry and produce the newly-enabled siblings. backendHash
+// must be backendHash(), so that turning -pack_archive on or off against an
+// already-rendered -serving_dir is itself enough to invalidate every entry.
+func (m *manifest) stale(artifact string, sourceHash, xrefHash, templateHash, encodingHash, backendHash [sha256.Size]byte) bool {
+	prev, ok := m.lookup(artifact)
+	return !ok ||
+		prev.SourceHash != sourceHash ||
+		prev.XrefHash != xrefHash ||
+		prev.TemplateHash != templateHash ||
+		prev.EncodingHash != encodingHash ||
+		prev.BackendHash != backendHash
+}
+
+// save atomically writes the manifest back to its path.
+func (m *manifest) save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := ioutil.TempFile(filepath.Dir(m.path), "debiman-manifest-")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := gob.NewEncoder(f).Encode(m.entries); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), m.path)
+}
+
+// templateSetHash summarizes every template debiman renders with, so that
+// changing a template (e.g. editing the CSS or the manpage layout) is
+// enough to invalidate every manifest entry and trigger a full re-render.
+// It is computed once at startup.
+var templateSetHash = hashStrings([]string{
+	headerContent,
+	footerContent,
+	styleContent,
+	manpageContent,
+	manpageerrorContent,
+	contentsContent,
+	pkgindexContent,
+	indexContent,
+	faqContent,
+})
+
+// hashStrings returns a hash of ss that does not depend on the order its
+// elements are passed in, used to summarize the set of inputs (manpage
+// names, binary package names, …) that a derived artifact was built from.
+func hashStrings(ss []string) [sha256.Size]byte {
+	sorted := append([]string(nil), ss...)
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	for _, s := range sorted {
+		io.WriteString(h, s)
+		h.Write([]byte{0})
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// encodingSetHash summarizes the currently enabled encodings (see
+// encodingExtensions), for folding into manifestEntry.EncodingHash. It reads
+// -enable_brotli/-enable_zstd at call time rather than once at startup like
+// templateSetHash, since flags are not parsed yet when package-level vars
+// are initialized.
+func encodingSetHash() [sha256.Size]byte {
+	return hashStrings(encodingExtensions())
+}
+
+// backendHash summarizes which backend this run writes rendered artifacts
+// with, for folding into manifestEntry.BackendHash. -pack_archive writes no
+// per-file sibling at all (writeAtomically hands content to the archive and
+// returns before reaching compressAll), so an entry recorded while it was
+// set must not be mistaken for an up-to-date per-file artifact once
+// -pack_archive is turned back off, or vice versa.
+func backendHash() [sha256.Size]byte {
+	backend := "file"
+	if *packArchive != "" {
+		backend = "archive"
+	}
+	return hashStrings([]string{backend})
+}
+
+// hashXref summarizes the set of versions a manpage is cross-referenced
+// against (used to rebuild "also available in other versions/languages"
+// links), so that a manpage is re-rendered whenever a sibling version
+// appears, disappears, or moves.
+func hashXref(versions []*manpage.Meta) [sha256.Size]byte {
+	paths := make([]string, len(versions))
+	for i, v := range versions {
+		paths[i] = v.ServingPath()
+	}
+	return hashStrings(paths)
+}
+
+// hashFile returns the sha256 of the file at path's content.
+func hashFile(path string) ([sha256.Size]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// outputDigests records the sha256 of the uncompressed bytes most recently
+// passed to writeAtomically for a given dest, so that renderAll can fold the
+// output digest into a manifestEntry without re-reading the artifact back
+// from disk (or, in -pack_archive mode, from the archive).
+var outputDigests sync.Map // map[string][sha256.Size]byte
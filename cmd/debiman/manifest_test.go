@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestStale(t *testing.T) {
+	m := &manifest{entries: make(map[string]manifestEntry)}
+
+	srcHash := sha256.Sum256([]byte("source-v1"))
+	xrefHash := sha256.Sum256([]byte("xref-v1"))
+	tmplHash := sha256.Sum256([]byte("templates-v1"))
+	encHash := sha256.Sum256([]byte("gz"))
+	beHash := sha256.Sum256([]byte("file"))
+
+	if !m.stale("a.html.gz", srcHash, xrefHash, tmplHash, encHash, beHash) {
+		t.Fatal("a never-seen artifact must be stale")
+	}
+
+	m.update("a.html.gz", manifestEntry{
+		SourceHash:   srcHash,
+		XrefHash:     xrefHash,
+		TemplateHash: tmplHash,
+		EncodingHash: encHash,
+		BackendHash:  beHash,
+	})
+	if m.stale("a.html.gz", srcHash, xrefHash, tmplHash, encHash, beHash) {
+		t.Fatal("an artifact whose inputs are unchanged must not be stale")
+	}
+
+	otherSrcHash := sha256.Sum256([]byte("source-v2"))
+	if !m.stale("a.html.gz", otherSrcHash, xrefHash, tmplHash, encHash, beHash) {
+		t.Error("a changed source hash must invalidate the entry")
+	}
+	otherXrefHash := sha256.Sum256([]byte("xref-v2"))
+	if !m.stale("a.html.gz", srcHash, otherXrefHash, tmplHash, encHash, beHash) {
+		t.Error("a changed xref hash must invalidate the entry")
+	}
+	otherTmplHash := sha256.Sum256([]byte("templates-v2"))
+	if !m.stale("a.html.gz", srcHash, xrefHash, otherTmplHash, encHash, beHash) {
+		t.Error("a changed template hash must invalidate the entry")
+	}
+	// Enabling -enable_brotli/-enable_zstd after the fact must itself be
+	// enough to invalidate an otherwise-unchanged entry, so the new
+	// sibling encodings get produced.
+	otherEncHash := sha256.Sum256([]byte("gz,br"))
+	if !m.stale("a.html.gz", srcHash, xrefHash, tmplHash, otherEncHash, beHash) {
+		t.Error("a changed encoding-set hash must invalidate the entry")
+	}
+	// Turning -pack_archive on or off against an already-rendered
+	// -serving_dir must itself be enough to invalidate an otherwise
+	// unchanged entry: an entry recorded by one backend says nothing
+	// about whether the other backend's output actually exists on disk.
+	otherBeHash := sha256.Sum256([]byte("archive"))
+	if !m.stale("a.html.gz", srcHash, xrefHash, tmplHash, encHash, otherBeHash) {
+		t.Error("a changed backend hash must invalidate the entry")
+	}
+}
+
+func TestBackendHashChangesWithPackArchive(t *testing.T) {
+	if *packArchive != "" {
+		t.Fatal("packArchive must default to empty")
+	}
+	fileHash := backendHash()
+
+	*packArchive = "/tmp/site.archive"
+	defer func() { *packArchive = "" }()
+	archiveHash := backendHash()
+
+	if fileHash == archiveHash {
+		t.Error("backendHash must differ between the default per-file backend and -pack_archive")
+	}
+}
+
+// TestManifestArchiveRunThenDefaultRunReRenders reproduces the scenario a
+// real invocation goes through: an artifact is recorded while -pack_archive
+// was set (so writeAtomically never wrote a per-file sibling for it), then
+// a later run against the same -serving_dir has -pack_archive unset again.
+// That artifact must come back stale, or the per-file tree would silently
+// stay empty forever.
+func TestManifestArchiveRunThenDefaultRunReRenders(t *testing.T) {
+	srcHash := sha256.Sum256([]byte("source"))
+	xrefHash := sha256.Sum256([]byte("xref"))
+	tmplHash := sha256.Sum256([]byte("templates"))
+	encHash := sha256.Sum256([]byte("gz"))
+
+	m := &manifest{entries: make(map[string]manifestEntry)}
+
+	*packArchive = "/tmp/site.archive"
+	archiveRun := backendHash()
+	m.update("a.html.gz", manifestEntry{
+		SourceHash:   srcHash,
+		XrefHash:     xrefHash,
+		TemplateHash: tmplHash,
+		EncodingHash: encHash,
+		BackendHash:  archiveRun,
+	})
+	*packArchive = ""
+
+	defaultRun := backendHash()
+	if !m.stale("a.html.gz", srcHash, xrefHash, tmplHash, encHash, defaultRun) {
+		t.Fatal("an artifact recorded under -pack_archive must be stale once -pack_archive is unset, so the missing per-file artifact gets rendered")
+	}
+}
+
+func TestManifestSaveLoadRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), manifestFilename)
+
+	m, err := loadManifest(path)
+	if err != nil {
+		t.Fatalf("loadManifest(nonexistent): %v", err)
+	}
+	entry := manifestEntry{
+		SourceHash:   sha256.Sum256([]byte("source")),
+		TemplateHash: sha256.Sum256([]byte("templates")),
+		EncodingHash: sha256.Sum256([]byte("gz")),
+		BackendHash:  sha256.Sum256([]byte("file")),
+	}
+	m.update("a.html.gz", entry)
+	if err := m.save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	reloaded, err := loadManifest(path)
+	if err != nil {
+		t.Fatalf("loadManifest(reload): %v", err)
+	}
+	got, ok := reloaded.lookup("a.html.gz")
+	if !ok {
+		t.Fatal("entry did not survive the save/load round trip")
+	}
+	if got != entry {
+		t.Errorf("reloaded entry = %+v, want %+v", got, entry)
+	}
+}
+
+func TestHashStringsOrderIndependent(t *testing.T) {
+	a := hashStrings([]string{"foo", "bar", "baz"})
+	b := hashStrings([]string{"baz", "foo", "bar"})
+	if a != b {
+		t.Error("hashStrings must not depend on input order")
+	}
+	c := hashStrings([]string{"foo", "bar"})
+	if a == c {
+		t.Error("hashStrings must depend on the actual set of inputs")
+	}
+}
@@ -2,7 +2,8 @@ package main
 
 import (
 	"bufio"
-	"compress/gzip"
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"html/template"
 	"io"
@@ -11,9 +12,10 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/Debian/debiman/internal/manpage"
+	"github.com/Debian/debiman/internal/zimwriter"
 	"golang.org/x/net/context"
 	"golang.org/x/sync/errgroup"
 )
@@ -35,7 +37,71 @@ func parseCommonTemplates() *template.Template {
 	return t
 }
 
-func writeAtomically(dest string, write func(w io.Writer) error) error {
+// currentArchive is non-nil while -pack_archive is set, in which case
+// writeAtomically appends to it instead of writing one file per artifact.
+// It is set up and sealed by renderAll.
+var currentArchive *archiveWriter
+
+// writeAtomically calls write to render the artifact once, then encodes the
+// result into dest (which must end in ".gz") and, for every additionally
+// enabled encoding (see -enable_brotli, -enable_zstd), into dest’s sibling
+// file with the corresponding extension, e.g. foo.html.br and foo.html.zst
+// next to foo.html.gz. Every file is written to a temporary file in the
+// destination directory first and then renamed into place, so readers never
+// observe a partially-written artifact.
+//
+// If -pack_archive is set, dest is instead appended to the shared archive
+// (see currentArchive) and no per-artifact file is written.
+//
+// ctx is only consulted while waiting on the render memory budget (see
+// acquireRenderMemory): once a worker has started writing, it runs to
+// completion even if ctx is later cancelled, so a cancelled errgroup cannot
+// leave a partially-written artifact behind.
+func writeAtomically(ctx context.Context, dest string, write func(w io.Writer) error) error {
+	var rendered bytes.Buffer
+	if err := write(&rendered); err != nil {
+		return err
+	}
+	content := rendered.Bytes()
+	metrics.bytesIn.Add(int64(len(content)))
+
+	// Hold content in the render memory budget until it has been written
+	// out (or handed to the archive/ZIM builder, which copy it), so that a
+	// burst of large manpages cannot accumulate unbounded rendered-but-
+	// unwritten HTML in memory. ctx is the errgroup's context, so a worker
+	// blocked here bails out as soon as a sibling worker fails fatally,
+	// instead of waiting on unrelated releases to free up budget.
+	if err := acquireRenderMemory(ctx, int64(len(content))); err != nil {
+		return err
+	}
+	defer releaseRenderMemory(int64(len(content)))
+
+	outputDigests.Store(dest, sha256.Sum256(content))
+
+	if currentZim != nil {
+		renderedContents.Store(dest, append([]byte(nil), content...))
+	}
+
+	if currentArchive != nil {
+		rel, err := filepath.Rel(*servingDir, dest)
+		if err != nil {
+			rel = dest
+		}
+		if err := currentArchive.add(rel, content); err != nil {
+			return err
+		}
+		metrics.jobsDone.Add(1)
+		return nil
+	}
+
+	if err := compressAll(dest, content); err != nil {
+		return err
+	}
+	metrics.jobsDone.Add(1)
+	return nil
+}
+
+func writeEncoded(dest string, ext string, content []byte) error {
 	f, err := ioutil.TempFile(filepath.Dir(dest), "debiman-")
 	if err != nil {
 		return err
@@ -43,24 +109,19 @@ func writeAtomically(dest string, write func(w io.Writer) error) error {
 	defer f.Close()
 	// TODO: defer os.Remove() in case we return before the tempfile is destroyed
 
-	// TODO(later): benchmark/support other compression algorithms. zopfli gets dos2unix from 9659B to 9274B (4% win)
-
 	bufw := bufio.NewWriter(f)
 
-	// NOTE(stapelberg): gzip’s decompression phase takes the same
-	// time, regardless of compression level. Hence, we invest the
-	// maximum CPU time once to achieve the best compression.
-	gzipw, err := gzip.NewWriterLevel(bufw, gzip.BestCompression)
+	enc, err := newEncoder(bufw, ext)
 	if err != nil {
 		return err
 	}
-	defer gzipw.Close()
+	defer enc.Close()
 
-	if err := write(gzipw); err != nil {
+	if _, err := enc.Write(content); err != nil {
 		return err
 	}
 
-	if err := gzipw.Close(); err != nil {
+	if err := enc.Close(); err != nil {
 		return err
 	}
 
@@ -80,6 +141,56 @@ func writeAtomically(dest string, write func(w io.Writer) error) error {
 }
 
 func renderAll(gv globalView) error {
+	startMetricsServer()
+
+	if *packArchive != "" {
+		aw, err := newArchiveWriter(*packArchive)
+		if err != nil {
+			return err
+		}
+		currentArchive = aw
+		defer func() { currentArchive = nil }()
+	}
+
+	mf, err := loadManifest(filepath.Join(*servingDir, manifestFilename))
+	if err != nil {
+		return err
+	}
+	encHash := encodingSetHash()
+	beHash := backendHash()
+
+	// zimChan carries one Article per rendered page to the goroutine
+	// feeding currentZim, so that renderAll's worker pool never blocks on
+	// zimwriter's internal locking.
+	var zimChan chan zimwriter.Article
+	var zimWg sync.WaitGroup
+	if *zimOutput != "" {
+		currentZim = zimwriter.New()
+		defer func() { currentZim = nil }()
+
+		zimChan = make(chan zimwriter.Article)
+		zimWg.Add(1)
+		go func() {
+			defer zimWg.Done()
+			for a := range zimChan {
+				if err := currentZim.Add(a); err != nil {
+					log.Printf("zimwriter: %v", err)
+				}
+			}
+		}()
+	}
+
+	// currentArchive and currentZim are each rebuilt from scratch on every
+	// run (a fresh temporary file, an empty Writer), but are only populated
+	// from inside writeAtomically/zimArticle as a side effect of actually
+	// rendering a page. Skipping unchanged pages via mf.stale would
+	// therefore silently drop them from the archive/ZIM, so force every
+	// artifact to be considered stale while either output is active.
+	forceFullRender := currentArchive != nil || currentZim != nil
+	if forceFullRender {
+		log.Printf("-pack_archive/-zim_output active: forcing a full render, ignoring the manifest")
+	}
+
 	binsBySuite := make(map[string][]string)
 
 	suitedirs, err := ioutil.ReadDir(*servingDir)
@@ -118,19 +229,38 @@ func renderAll(gv globalView) error {
 		meta     *manpage.Meta
 		versions []*manpage.Meta
 		xref     map[string][]*manpage.Meta
+		artifact string // dest, relative to *servingDir: the manifest key
+		srcHash  [sha256.Size]byte
+		xrefHash [sha256.Size]byte
 	}
 	eg, ctx := errgroup.WithContext(context.Background())
 	renderChan := make(chan renderJob)
-	// TODO: flag for parallelism level
-	for i := 0; i < 30; i++ {
+	for i := 0; i < *renderConcurrency; i++ {
 		eg.Go(func() error {
 			for r := range renderChan {
-				if err := rendermanpage(r.dest, r.src, r.meta, r.versions, r.xref); err != nil {
+				if err := rendermanpage(ctx, r.dest, r.src, r.meta, r.versions, r.xref); err != nil {
 					// render writes an error page if rendering
 					// failed, any returned error is severe (e.g. file
 					// system full) and should lead to termination.
 					return err
 				}
+				var outputDigest [sha256.Size]byte
+				if v, ok := outputDigests.Load(r.dest); ok {
+					outputDigest = v.([sha256.Size]byte)
+				}
+				mf.update(r.artifact, manifestEntry{
+					SourceHash:   r.srcHash,
+					XrefHash:     r.xrefHash,
+					TemplateHash: templateSetHash,
+					EncodingHash: encHash,
+					BackendHash:  beHash,
+					OutputDigest: outputDigest,
+				})
+				if zimChan != nil {
+					if a, ok := zimArticle(r.artifact, r.meta.Name, r.dest); ok {
+						zimChan <- a
+					}
+				}
 			}
 			return nil
 		})
@@ -147,24 +277,17 @@ func renderAll(gv globalView) error {
 	}
 
 	// the invariant is: each file ending in .gz must have a corresponding .html.gz file
-	// the .html.gz must have a modtime that is >= the modtime of the .gz file
+	// (plus a sibling .html.br/.html.zst for every additionally enabled
+	// encoding); renderAll re-renders an artifact whenever its manifest
+	// entry is missing or the source/xref/template hashes it was recorded
+	// with no longer match.
 	for dir, files := range contents {
 		if whitelist != nil && !whitelist[filepath.Base(dir)] {
 			continue
 		}
 
-		fileByName := make(map[string]os.FileInfo, len(files))
-		for _, f := range files {
-			fileByName[f.Name()] = f
-		}
-
 		manpageByName := make(map[string]*manpage.Meta, len(files))
-
-		var indexModTime time.Time
-		if fi, ok := fileByName["index.html.gz"]; ok {
-			indexModTime = fi.ModTime()
-		}
-		var indexNeedsUpdate bool
+		var pkgindexSources []string
 
 		for _, f := range files {
 			full := filepath.Join(dir, f.Name())
@@ -176,10 +299,6 @@ func renderAll(gv globalView) error {
 				continue
 			}
 
-			if f.ModTime().After(indexModTime) {
-				indexNeedsUpdate = true
-			}
-
 			m, err := manpage.FromServingPath(*servingDir, full)
 			if err != nil {
 				// If we run into this case, our code cannot correctly
@@ -190,10 +309,22 @@ func renderAll(gv globalView) error {
 
 			manpageByName[f.Name()] = m
 
+			srcHash, err := hashFile(full)
+			if err != nil {
+				return err
+			}
+			versions := gv.xref[m.Name]
+			xrefHash := hashXref(versions)
+			pkgindexSources = append(pkgindexSources, f.Name()+fmt.Sprintf("%x", srcHash))
+
 			n := strings.TrimSuffix(f.Name(), ".gz") + ".html.gz"
-			html, ok := fileByName[n]
-			if !ok || html.ModTime().Before(f.ModTime()) {
-				versions := gv.xref[m.Name]
+			dest := filepath.Join(dir, n)
+			artifact, err := filepath.Rel(*servingDir, dest)
+			if err != nil {
+				artifact = dest
+			}
+
+			if forceFullRender || mf.stale(artifact, srcHash, xrefHash, templateSetHash, encHash, beHash) {
 				// Replace m with its corresponding entry in versions
 				// so that render() can use pointer equality to
 				// efficiently skip entries.
@@ -205,11 +336,14 @@ func renderAll(gv globalView) error {
 				}
 				select {
 				case renderChan <- renderJob{
-					dest:     filepath.Join(dir, n),
+					dest:     dest,
 					src:      full,
 					meta:     m,
 					versions: versions,
 					xref:     gv.xref,
+					artifact: artifact,
+					srcHash:  srcHash,
+					xrefHash: xrefHash,
 				}:
 				case <-ctx.Done():
 					break
@@ -217,13 +351,35 @@ func renderAll(gv globalView) error {
 			}
 		}
 
-		if !indexNeedsUpdate {
+		indexDest := filepath.Join(dir, "index.html.gz")
+		indexArtifact, err := filepath.Rel(*servingDir, indexDest)
+		if err != nil {
+			indexArtifact = indexDest
+		}
+		indexSourceHash := hashStrings(pkgindexSources)
+		if !forceFullRender && !mf.stale(indexArtifact, indexSourceHash, [sha256.Size]byte{}, templateSetHash, encHash, beHash) {
 			continue
 		}
 
-		if err := renderPkgindex(filepath.Join(dir, "index.html.gz"), manpageByName); err != nil {
+		if err := renderPkgindex(indexDest, manpageByName); err != nil {
 			return err
 		}
+		var outputDigest [sha256.Size]byte
+		if v, ok := outputDigests.Load(indexDest); ok {
+			outputDigest = v.([sha256.Size]byte)
+		}
+		mf.update(indexArtifact, manifestEntry{
+			SourceHash:   indexSourceHash,
+			TemplateHash: templateSetHash,
+			EncodingHash: encHash,
+			BackendHash:  beHash,
+			OutputDigest: outputDigest,
+		})
+		if zimChan != nil {
+			if a, ok := zimArticle(indexArtifact, filepath.Base(dir), indexDest); ok {
+				zimChan <- a
+			}
+		}
 	}
 	close(renderChan)
 	if err := eg.Wait(); err != nil {
@@ -231,10 +387,54 @@ func renderAll(gv globalView) error {
 	}
 
 	for suite, bins := range binsBySuite {
-		if err := renderContents(filepath.Join(*servingDir, fmt.Sprintf("contents-%s.html.gz", suite)), suite, bins); err != nil {
+		contentsDest := filepath.Join(*servingDir, fmt.Sprintf("contents-%s.html.gz", suite))
+		contentsArtifact, err := filepath.Rel(*servingDir, contentsDest)
+		if err != nil {
+			contentsArtifact = contentsDest
+		}
+		contentsSourceHash := hashStrings(bins)
+		if !forceFullRender && !mf.stale(contentsArtifact, contentsSourceHash, [sha256.Size]byte{}, templateSetHash, encHash, beHash) {
+			continue
+		}
+
+		if err := renderContents(contentsDest, suite, bins); err != nil {
+			return err
+		}
+		var outputDigest [sha256.Size]byte
+		if v, ok := outputDigests.Load(contentsDest); ok {
+			outputDigest = v.([sha256.Size]byte)
+		}
+		mf.update(contentsArtifact, manifestEntry{
+			SourceHash:   contentsSourceHash,
+			TemplateHash: templateSetHash,
+			EncodingHash: encHash,
+			BackendHash:  beHash,
+			OutputDigest: outputDigest,
+		})
+		if zimChan != nil {
+			if a, ok := zimArticle(contentsArtifact, fmt.Sprintf("Contents of %s", suite), contentsDest); ok {
+				zimChan <- a
+			}
+		}
+	}
+
+	if zimChan != nil {
+		close(zimChan)
+		zimWg.Wait()
+		if err := currentZim.Write(*zimOutput); err != nil {
+			return err
+		}
+	}
+
+	if err := mf.save(); err != nil {
+		return err
+	}
+
+	if currentArchive != nil {
+		if err := currentArchive.Seal(); err != nil {
 			return err
 		}
 	}
 
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/semaphore"
+)
+
+var (
+	renderConcurrency = flag.Int("render_concurrency",
+		runtime.NumCPU(),
+		"number of concurrent mandoc invocations (I/O-bound). "+
+			"Defaults to the number of CPUs, but mandoc mostly waits on exec(2)/pipes, "+
+			"so raising this past NumCPU() can still help on a fast disk")
+
+	compressConcurrency = flag.Int("compress_concurrency",
+		runtime.NumCPU(),
+		"number of concurrent compression workers (CPU-bound: gzip/brotli/zstd). "+
+			"Kept separate from -render_concurrency so mandoc invocations are never "+
+			"starved of CPU by compression, and vice versa")
+
+	renderMemoryBudget = flag.Int64("render_memory_budget",
+		512<<20, // 512 MiB
+		"approximate upper bound, in bytes, on rendered-but-not-yet-written HTML "+
+			"held in memory at once; renderAll throttles new render jobs once exceeded")
+
+	metricsListen = flag.String("metrics_listen",
+		"",
+		"if non-empty, serve Prometheus-style text metrics (jobs done, bytes in/out, "+
+			"compression ratio, queue depth) on this address, e.g. \":8081\"")
+)
+
+// renderMemory bounds the total size of rendered-but-not-yet-compressed HTML
+// buffers held by in-flight writeAtomically calls. It is sized lazily from
+// -render_memory_budget the first time it is acquired, since flags are not
+// parsed yet when package-level vars are initialized.
+var (
+	renderMemoryOnce sync.Once
+	renderMemory     *semaphore.Weighted
+)
+
+// acquireRenderMemory reserves n bytes of the render memory budget,
+// blocking until they become available or ctx is done. A single artifact
+// bigger than the whole budget is clamped to it, so Acquire cannot block
+// forever on an unreasonably small -render_memory_budget.
+func acquireRenderMemory(ctx context.Context, n int64) error {
+	renderMemoryOnce.Do(func() {
+		renderMemory = semaphore.NewWeighted(*renderMemoryBudget)
+	})
+	if n > *renderMemoryBudget {
+		n = *renderMemoryBudget
+	}
+	return renderMemory.Acquire(ctx, n)
+}
+
+func releaseRenderMemory(n int64) {
+	if n > *renderMemoryBudget {
+		n = *renderMemoryBudget
+	}
+	renderMemory.Release(n)
+}
+
+// compressWorkChan carries queued units of CPU-bound compression work;
+// each func() does its own encoding and reports its own result, so that both
+// the per-file (compressAll) and -pack_archive (compressAllForArchive) backends
+// can share a single pool instead of each running its own.
+var (
+	compressPoolOnce sync.Once
+	compressWorkChan chan func()
+)
+
+// startCompressPool lazily starts the CPU-bound compression worker pool,
+// sized by -compress_concurrency, the first time it is needed. Keeping
+// compression in its own pool (rather than doing it inline in the
+// mandoc-invoking goroutines) means a burst of large manpages does not
+// starve compression of CPU, or vice versa.
+func startCompressPool() {
+	compressPoolOnce.Do(func() {
+		n := *compressConcurrency
+		if n < 1 {
+			n = 1
+		}
+		// Buffered so handing off a compression job does not wait for a
+		// compression worker to become free. compressAll and
+		// compressAllForArchive still wait for their jobs' results before
+		// returning, so the calling render worker does too.
+		compressWorkChan = make(chan func(), n*4)
+		for i := 0; i < n; i++ {
+			go func() {
+				for job := range compressWorkChan {
+					job()
+				}
+			}()
+		}
+	})
+}
+
+// compressAll fans content out to the compression pool once per enabled
+// encoding, writing each to dest's sibling file (see withEncodingExt), and
+// waits for all of them to finish, returning the first error (if any).
+func compressAll(dest string, content []byte) error {
+	startCompressPool()
+
+	exts := encodingExtensions()
+	done := make(chan error, len(exts))
+	for _, ext := range exts {
+		ext := ext
+		metrics.queueDepth.Add(1)
+		compressWorkChan <- func() {
+			defer metrics.queueDepth.Add(-1)
+			out := withEncodingExt(dest, ext)
+			err := writeEncoded(out, ext, content)
+			if err == nil {
+				if fi, statErr := os.Stat(out); statErr == nil {
+					metrics.bytesOut.Add(fi.Size())
+				}
+			}
+			metrics.compressJobsDone.Add(1)
+			done <- err
+		}
+	}
+
+	var firstErr error
+	for range exts {
+		if err := <-done; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// compressAllForArchive encodes content with every currently enabled
+// encoding on the shared CPU-bound compress pool (see startCompressPool),
+// dispatching all of them up front and waiting for all to finish together —
+// the same way compressAll does for the per-file backend — so that a
+// single artifact's gz/br/zst encodings run concurrently instead of one at
+// a time. The returned map is keyed by extension ("gz", "br", "zst").
+func compressAllForArchive(content []byte) (map[string][]byte, error) {
+	startCompressPool()
+
+	exts := encodingExtensions()
+	type result struct {
+		ext     string
+		encoded []byte
+		err     error
+	}
+	done := make(chan result, len(exts))
+	for _, ext := range exts {
+		ext := ext
+		metrics.queueDepth.Add(1)
+		compressWorkChan <- func() {
+			defer metrics.queueDepth.Add(-1)
+			encoded, err := encodeForArchive(content, ext)
+			if err == nil {
+				metrics.bytesOut.Add(int64(len(encoded)))
+			}
+			metrics.compressJobsDone.Add(1)
+			done <- result{ext, encoded, err}
+		}
+	}
+
+	encoded := make(map[string][]byte, len(exts))
+	var firstErr error
+	for range exts {
+		r := <-done
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		encoded[r.ext] = r.encoded
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return encoded, nil
+}
+
+// counter is an int64 counter safe for concurrent use, so that call sites
+// read naturally (metrics.jobsDone.Add(1)) instead of spelling out
+// atomic.AddInt64(&metrics.jobsDone, 1) everywhere.
+type counter int64
+
+func (c *counter) Add(delta int64) { atomic.AddInt64((*int64)(c), delta) }
+func (c *counter) Load() int64     { return atomic.LoadInt64((*int64)(c)) }
+
+// renderMetrics holds the Prometheus-style counters exposed via
+// -metrics_listen: jobs done, bytes in/out, compression ratio, queue depth.
+type renderMetrics struct {
+	jobsDone         counter
+	compressJobsDone counter
+	bytesIn          counter
+	bytesOut         counter
+	queueDepth       counter
+}
+
+var metrics renderMetrics
+
+// startMetricsServer starts the -metrics_listen HTTP endpoint, if
+// configured. It is safe to call multiple times; only the first call has an
+// effect.
+var startMetricsServerOnce sync.Once
+
+func startMetricsServer() {
+	if *metricsListen == "" {
+		return
+	}
+	startMetricsServerOnce.Do(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", metricsHandler)
+		go func() {
+			log.Printf("serving metrics on %s", *metricsListen)
+			if err := http.ListenAndServe(*metricsListen, mux); err != nil {
+				log.Printf("metrics server: %v", err)
+			}
+		}()
+	})
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	bytesIn := metrics.bytesIn.Load()
+	bytesOut := metrics.bytesOut.Load()
+	var ratio float64
+	if bytesIn > 0 {
+		ratio = float64(bytesOut) / float64(bytesIn)
+	}
+
+	fmt.Fprintf(w, "# TYPE debiman_render_jobs_done counter\n")
+	fmt.Fprintf(w, "debiman_render_jobs_done %d\n", metrics.jobsDone.Load())
+	fmt.Fprintf(w, "# TYPE debiman_compress_jobs_done counter\n")
+	fmt.Fprintf(w, "debiman_compress_jobs_done %d\n", metrics.compressJobsDone.Load())
+	fmt.Fprintf(w, "# TYPE debiman_render_bytes_in counter\n")
+	fmt.Fprintf(w, "debiman_render_bytes_in %d\n", bytesIn)
+	fmt.Fprintf(w, "# TYPE debiman_render_bytes_out counter\n")
+	fmt.Fprintf(w, "debiman_render_bytes_out %d\n", bytesOut)
+	fmt.Fprintf(w, "# TYPE debiman_render_compression_ratio gauge\n")
+	fmt.Fprintf(w, "debiman_render_compression_ratio %f\n", ratio)
+	fmt.Fprintf(w, "# TYPE debiman_render_queue_depth gauge\n")
+	fmt.Fprintf(w, "debiman_render_queue_depth %d\n", metrics.queueDepth.Load())
+}
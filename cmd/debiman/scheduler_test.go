@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	var c counter
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Add(1)
+		}()
+	}
+	wg.Wait()
+	if got := c.Load(); got != 100 {
+		t.Errorf("counter.Load() = %d, want 100", got)
+	}
+}
+
+func TestCompressAllWritesSiblingsAndMetrics(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "page.html.gz")
+	content := []byte("<html>hello</html>")
+
+	before := metrics.compressJobsDone.Load()
+	if err := compressAll(dest, content); err != nil {
+		t.Fatalf("compressAll: %v", err)
+	}
+	after := metrics.compressJobsDone.Load()
+	if after <= before {
+		t.Errorf("compressJobsDone did not advance: before=%d after=%d", before, after)
+	}
+
+	// Only "gz" is enabled by default (enableBrotli/enableZstd are false
+	// unless another test flips them), so exactly the .gz sibling should
+	// exist.
+	got, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("reading compressed sibling: %v", err)
+	}
+	if len(got) == 0 {
+		t.Error("compressed sibling is empty")
+	}
+}
+
+func TestCompressAllForArchiveDispatchesEveryEncoding(t *testing.T) {
+	*enableBrotli = true
+	*enableZstd = true
+	defer func() {
+		*enableBrotli = false
+		*enableZstd = false
+	}()
+
+	content := []byte("<html>hello</html>")
+
+	before := metrics.compressJobsDone.Load()
+	encoded, err := compressAllForArchive(content)
+	if err != nil {
+		t.Fatalf("compressAllForArchive: %v", err)
+	}
+	after := metrics.compressJobsDone.Load()
+	if got, want := after-before, int64(3); got != want {
+		t.Errorf("compressJobsDone advanced by %d, want %d (gz/br/zst dispatched together)", got, want)
+	}
+
+	for _, ext := range []string{"gz", "br", "zst"} {
+		if len(encoded[ext]) == 0 {
+			t.Errorf("compressAllForArchive returned no %q encoding", ext)
+		}
+	}
+}
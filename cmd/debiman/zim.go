@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"sync"
+
+	"github.com/Debian/debiman/internal/zimwriter"
+)
+
+var zimOutput = flag.String("zim_output",
+	"",
+	"if non-empty, also build a self-contained openZIM bundle of the rendered site at this path, "+
+		"for offline reading with Kiwix. WARNING: the ZIM is only sealed once (via Writer.Write) "+
+		"after every page has rendered, so the whole site's uncompressed content is held in memory "+
+		"for the duration of the run: -render_memory_budget does not bound it, since that budget is "+
+		"released as soon as writeAtomically hands content off to the ZIM builder, not once the ZIM "+
+		"builder itself is done with it. Do not set this for a full-mirror render of a multi-million-"+
+		"page site without enough RAM to hold it all")
+
+// currentZim is non-nil while -zim_output is set. renderAll feeds it from a
+// single goroutine reading zimChan, so Writer.Add itself never needs to be
+// called concurrently, but it is safe for that anyway.
+var currentZim *zimwriter.Writer
+
+// renderedContents mirrors outputDigests (see manifest.go), but keeps the
+// full rendered bytes rather than just their hash, for as long as it takes
+// the single zimArticle-consuming goroutine to drain zimChan and hand them
+// to currentZim.Add. Individual entries are short-lived, but currentZim
+// itself retains every Article's Content until Write seals the archive (see
+// the -zim_output flag doc), so this does not bound -zim_output's memory
+// use over the course of a whole run, only the brief render-to-consume gap.
+var renderedContents sync.Map // map[string][]byte, keyed by dest
+
+// zimArticle builds the zimwriter.Article for a rendered manpage, using the
+// bytes writeAtomically stashed in renderedContents for dest. servingPath is
+// the on-disk artifact path, e.g. "stretch/coreutils/dos2unix.1.en.html.gz";
+// every intra-site hyperlink debiman renders targets the uncompressed
+// ".html" path (the ".gz" is only the compressed on-disk form a web server
+// strips before serving), so the ".gz" suffix is trimmed to make the URL
+// the article is stored under match the links pointing at it.
+func zimArticle(servingPath, title, dest string) (zimwriter.Article, bool) {
+	v, ok := renderedContents.Load(dest)
+	if !ok {
+		return zimwriter.Article{}, false
+	}
+	renderedContents.Delete(dest)
+	return zimwriter.Article{
+		Namespace: zimwriter.NamespaceArticle,
+		URL:       strings.TrimSuffix(servingPath, ".gz"),
+		Title:     title,
+		MimeType:  "text/html",
+		Content:   v.([]byte),
+	}, true
+}
@@ -0,0 +1,370 @@
+// Package zimwriter builds openZIM archives (the container format used by
+// Kiwix) out of rendered HTML pages, so that a site like
+// manpages.debian.org can be mirrored into a single file for offline
+// reading on airgapped or low-connectivity systems.
+//
+// It implements the subset of the openZIM v5 spec debiman needs: a
+// mimetype table, zstd-compressed clusters of content blobs, URL/title
+// pointer lists and the final header with its trailing MD5 checksum. It is
+// not a general-purpose ZIM library: there is no support for redirects,
+// for instance, since debiman has no use for them.
+package zimwriter
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Namespace identifies which part of the ZIM an Article belongs to, per the
+// openZIM spec: 'A' for articles (the HTML pages themselves), 'I' for
+// binary assets such as images, stylesheets or scripts, and 'M' for
+// metadata (Title, Creator, …).
+type Namespace byte
+
+const (
+	NamespaceArticle  Namespace = 'A'
+	NamespaceAsset    Namespace = 'I'
+	NamespaceMetadata Namespace = 'M'
+)
+
+// Article is one entry to be stored in the ZIM archive.
+type Article struct {
+	Namespace Namespace
+	URL       string // unique within Namespace, e.g. "stretch/coreutils/dos2unix.1.en.html"
+	Title     string // display title; may be empty, in which case URL is used
+	MimeType  string
+	Content   []byte
+}
+
+// clusterSizeTarget is the approximate amount of uncompressed content
+// collected into one cluster before it is sealed and a new one is started.
+// Bigger clusters compress better; smaller clusters let a reader fetch one
+// article without inflating much unrelated data.
+const clusterSizeTarget = 4 << 20 // 4 MiB
+
+// Writer accumulates Articles and, once Write is called, serializes them
+// into a single ZIM file. All exported methods are safe for concurrent use.
+//
+// Writer retains every Article's Content in memory (to sort and cluster
+// them once the full set is known) until Write returns, so for a
+// full-site mirror the caller's peak memory use is proportional to the
+// whole site's rendered, uncompressed size. There is currently no
+// incremental/streaming mode that seals clusters as Articles arrive.
+type Writer struct {
+	mu        sync.Mutex
+	articles  []Article
+	mimeIndex map[string]uint16
+	mimeTypes []string
+}
+
+// New returns an empty Writer, ready to accept Articles.
+func New() *Writer {
+	return &Writer{mimeIndex: make(map[string]uint16)}
+}
+
+// Add queues a, to be written out by Write. It is safe to call Add from
+// multiple goroutines, e.g. once per finished render job.
+func (w *Writer) Add(a Article) error {
+	if a.URL == "" {
+		return fmt.Errorf("zimwriter: Article.URL must not be empty")
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.mimeIndex[a.MimeType]; !ok {
+		w.mimeIndex[a.MimeType] = uint16(len(w.mimeTypes))
+		w.mimeTypes = append(w.mimeTypes, a.MimeType)
+	}
+	w.articles = append(w.articles, a)
+	return nil
+}
+
+// dirent is the in-memory representation of one ZIM directory entry, filled
+// in once clustering has assigned each article to a cluster and blob
+// number.
+type dirent struct {
+	mimeType  uint16
+	namespace Namespace
+	url       string
+	title     string
+	cluster   uint32
+	blob      uint32
+}
+
+func (d dirent) serialize() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, d.mimeType)
+	buf.WriteByte(0) // parameter length: debiman stores no extra parameters
+	buf.WriteByte(byte(d.namespace))
+	binary.Write(&buf, binary.LittleEndian, int32(0)) // revision
+	binary.Write(&buf, binary.LittleEndian, d.cluster)
+	binary.Write(&buf, binary.LittleEndian, d.blob)
+	buf.WriteString(d.url)
+	buf.WriteByte(0)
+	if d.title != d.url {
+		buf.WriteString(d.title)
+	}
+	buf.WriteByte(0)
+	return buf.Bytes()
+}
+
+// zimMagic is the openZIM magic number ("ZIM\x04" interpreted as a
+// little-endian uint32).
+const zimMagic = 0x044d495a
+
+const headerSize = 80
+
+// Write serializes every queued Article into a sealed ZIM file at dest,
+// first writing to a temporary file in the same directory and renaming it
+// into place, matching the rest of debiman's atomic-write convention.
+func (w *Writer) Write(dest string) error {
+	w.mu.Lock()
+	articles := append([]Article(nil), w.articles...)
+	mimeTypes := append([]string(nil), w.mimeTypes...)
+	w.mu.Unlock()
+
+	// Stable, namespace-then-URL order is what both the URL pointer list
+	// and cluster assignment are built from.
+	sort.Slice(articles, func(i, j int) bool {
+		if articles[i].Namespace != articles[j].Namespace {
+			return articles[i].Namespace < articles[j].Namespace
+		}
+		return articles[i].URL < articles[j].URL
+	})
+
+	f, err := ioutil.TempFile(filepath.Dir(dest), "debiman-zim-")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mimeIndex := make(map[string]uint16, len(mimeTypes))
+	for i, mt := range mimeTypes {
+		mimeIndex[mt] = uint16(i)
+	}
+
+	dirents := make([]dirent, len(articles))
+	clusters, err := clusterArticles(articles, clusterSizeTarget)
+	if err != nil {
+		return err
+	}
+	blobOf := make(map[int]struct{ cluster, blob uint32 }, len(articles))
+	for ci, c := range clusters {
+		for bi, articleIdx := range c.articleIndices {
+			blobOf[articleIdx] = struct{ cluster, blob uint32 }{uint32(ci), uint32(bi)}
+		}
+	}
+	for i, a := range articles {
+		loc := blobOf[i]
+		dirents[i] = dirent{
+			mimeType:  mimeIndex[a.MimeType],
+			namespace: a.Namespace,
+			url:       a.URL,
+			title:     a.Title,
+			cluster:   loc.cluster,
+			blob:      loc.blob,
+		}
+	}
+
+	// Body layout: mimetype list, directory entries, cluster data. The
+	// pointer lists and header, which reference absolute offsets into this
+	// layout, are only known once it has all been written, so we buffer it
+	// and prepend the fixed-size parts afterwards.
+	var body bytes.Buffer
+	for _, mt := range mimeTypes {
+		body.WriteString(mt)
+		body.WriteByte(0)
+	}
+	body.WriteByte(0) // empty string terminates the mimetype list
+
+	direntOffsets := make([]int64, len(dirents))
+	for i, d := range dirents {
+		direntOffsets[i] = int64(body.Len())
+		body.Write(d.serialize())
+	}
+
+	clusterOffsets := make([]int64, len(clusters))
+	for i, c := range clusters {
+		clusterOffsets[i] = int64(body.Len())
+		encoded, err := c.serialize()
+		if err != nil {
+			return err
+		}
+		body.Write(encoded)
+	}
+
+	urlPtrPos := int64(headerSize)
+	urlPtrSize := int64(8 * len(dirents))
+	titleIdx := titlePointerOrder(articles)
+	titlePtrPos := urlPtrPos + urlPtrSize
+	titlePtrSize := int64(4 * len(titleIdx))
+	clusterPtrPos := titlePtrPos + titlePtrSize
+	clusterPtrSize := int64(8 * len(clusters))
+	mimeListPos := clusterPtrPos + clusterPtrSize
+
+	header := make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(header[0:4], zimMagic)
+	binary.LittleEndian.PutUint16(header[4:6], 5) // major version
+	binary.LittleEndian.PutUint16(header[6:8], 0) // minor version
+	// header[8:24] is the UUID; debiman does not need globally unique
+	// rebuild identities, so it is left zeroed.
+	binary.LittleEndian.PutUint32(header[24:28], uint32(len(dirents)))
+	binary.LittleEndian.PutUint32(header[28:32], uint32(len(clusters)))
+	binary.LittleEndian.PutUint64(header[32:40], uint64(urlPtrPos))
+	binary.LittleEndian.PutUint64(header[40:48], uint64(titlePtrPos))
+	binary.LittleEndian.PutUint64(header[48:56], uint64(clusterPtrPos))
+	binary.LittleEndian.PutUint64(header[56:64], uint64(mimeListPos))
+	binary.LittleEndian.PutUint32(header[64:68], 0xffffffff) // no main page
+	binary.LittleEndian.PutUint32(header[68:72], 0xffffffff) // no layout page
+
+	bodyStart := mimeListPos
+	checksumPos := bodyStart + int64(body.Len())
+	binary.LittleEndian.PutUint64(header[72:80], uint64(checksumPos))
+
+	h := md5.New()
+	mw := io.MultiWriter(f, h)
+
+	if _, err := mw.Write(header); err != nil {
+		return err
+	}
+	for _, off := range direntOffsets {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(bodyStart+off))
+		if _, err := mw.Write(b[:]); err != nil {
+			return err
+		}
+	}
+	for _, articleIdx := range titleIdx {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], uint32(articleIdx))
+		if _, err := mw.Write(b[:]); err != nil {
+			return err
+		}
+	}
+	for _, off := range clusterOffsets {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(bodyStart+off))
+		if _, err := mw.Write(b[:]); err != nil {
+			return err
+		}
+	}
+	if _, err := mw.Write(body.Bytes()); err != nil {
+		return err
+	}
+
+	if _, err := f.Write(h.Sum(nil)); err != nil {
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), dest)
+}
+
+// titlePointerOrder returns the index of every entry into articles (which is
+// itself sorted by namespace+URL and therefore matches the URL pointer
+// list order), re-ordered by Title. Per the openZIM spec the title pointer
+// list covers every namespace, not just NamespaceArticle, and its length
+// must match the dirent/URL pointer list count the header advertises;
+// returning a shorter, articles-only list here would desync every offset
+// that follows it (cluster pointer list, mimetype list).
+func titlePointerOrder(articles []Article) []int {
+	idx := make([]int, len(articles))
+	for i := range articles {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		return articleTitle(articles[idx[i]]) < articleTitle(articles[idx[j]])
+	})
+	return idx
+}
+
+func articleTitle(a Article) string {
+	if a.Title != "" {
+		return a.Title
+	}
+	return a.URL
+}
+
+// cluster groups several articles' content together so they can be
+// zstd-compressed as one unit; articleIndices[b] is the index (into the
+// sorted articles slice passed to Write) whose content is blob b.
+type cluster struct {
+	articleIndices []int
+	blobs          [][]byte
+}
+
+// clusterArticles greedily packs articles into clusters of approximately
+// sizeTarget uncompressed bytes each, in the order given (callers are
+// expected to have already sorted articles the way they want clusters to
+// group related content, e.g. by URL so that a manpage and its neighbours
+// in the same package end up in the same cluster).
+func clusterArticles(articles []Article, sizeTarget int) ([]cluster, error) {
+	var clusters []cluster
+	var cur cluster
+	curSize := 0
+	for i, a := range articles {
+		cur.articleIndices = append(cur.articleIndices, i)
+		cur.blobs = append(cur.blobs, a.Content)
+		curSize += len(a.Content)
+		if curSize >= sizeTarget {
+			clusters = append(clusters, cur)
+			cur = cluster{}
+			curSize = 0
+		}
+	}
+	if len(cur.blobs) > 0 {
+		clusters = append(clusters, cur)
+	}
+	return clusters, nil
+}
+
+// clusterCompressionZstd is the openZIM compression-type byte for zstd, per
+// the spec's cluster information byte (low nibble).
+const clusterCompressionZstd = 5
+
+// serialize returns the on-disk bytes of the cluster: one compression-type
+// byte, followed by the zstd-compressed blob-offset table and blob data.
+func (c cluster) serialize() ([]byte, error) {
+	offsets := make([]uint32, len(c.blobs)+1)
+	cur := uint32(4 * len(offsets))
+	offsets[0] = cur
+	for i, b := range c.blobs {
+		cur += uint32(len(b))
+		offsets[i+1] = cur
+	}
+
+	var raw bytes.Buffer
+	for _, o := range offsets {
+		binary.Write(&raw, binary.LittleEndian, o)
+	}
+	for _, b := range c.blobs {
+		raw.Write(b)
+	}
+
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	if err != nil {
+		return nil, err
+	}
+	compressed := enc.EncodeAll(raw.Bytes(), nil)
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(compressed)+1)
+	out = append(out, clusterCompressionZstd)
+	out = append(out, compressed...)
+	return out, nil
+}
@@ -0,0 +1,216 @@
+package zimwriter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// parsedDirent is the test's own decoding of dirent.serialize, since the
+// package has no reader counterpart to round-trip against.
+type parsedDirent struct {
+	mimeType  uint16
+	namespace Namespace
+	cluster   uint32
+	blob      uint32
+	url       string
+	title     string
+}
+
+func parseDirent(b []byte) parsedDirent {
+	var d parsedDirent
+	d.mimeType = binary.LittleEndian.Uint16(b[0:2])
+	// b[2] is the parameter length (always 0), b[3] is the namespace.
+	d.namespace = Namespace(b[3])
+	d.cluster = binary.LittleEndian.Uint32(b[8:12])
+	d.blob = binary.LittleEndian.Uint32(b[12:16])
+	rest := b[16:]
+	urlEnd := bytes.IndexByte(rest, 0)
+	d.url = string(rest[:urlEnd])
+	rest = rest[urlEnd+1:]
+	titleEnd := bytes.IndexByte(rest, 0)
+	d.title = string(rest[:titleEnd])
+	if d.title == "" {
+		d.title = d.url
+	}
+	return d
+}
+
+func parseMimeList(b []byte) []string {
+	var types []string
+	for {
+		end := bytes.IndexByte(b, 0)
+		if end == 0 {
+			break
+		}
+		types = append(types, string(b[:end]))
+		b = b[end+1:]
+	}
+	return types
+}
+
+func decompressCluster(b []byte) [][]byte {
+	if b[0] != clusterCompressionZstd {
+		panic("unexpected cluster compression type in test fixture")
+	}
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		panic(err)
+	}
+	raw, err := dec.DecodeAll(b[1:], nil)
+	if err != nil {
+		panic(err)
+	}
+	// raw starts with a table of uint32 blob-end-offsets (see
+	// cluster.serialize): offsets[0] is the end of the table itself,
+	// offsets[i+1] is the end of blob i.
+	firstOffset := binary.LittleEndian.Uint32(raw[0:4])
+	numBlobs := firstOffset/4 - 1
+	offsets := make([]uint32, numBlobs+1)
+	for i := range offsets {
+		offsets[i] = binary.LittleEndian.Uint32(raw[4*i : 4*i+4])
+	}
+	blobs := make([][]byte, numBlobs)
+	for i := range blobs {
+		blobs[i] = raw[offsets[i]:offsets[i+1]]
+	}
+	return blobs
+}
+
+// TestWriteRoundTrip writes a small ZIM with a mix of article and asset
+// entries and manually decodes the result, checking that the header's
+// pointer-list offsets, the directory entries and the compressed cluster
+// content are all mutually consistent and that every Article survives the
+// round trip unchanged.
+func TestWriteRoundTrip(t *testing.T) {
+	w := New()
+	articles := []Article{
+		{Namespace: NamespaceAsset, URL: "style.css", MimeType: "text/css", Content: []byte("body { color: red }")},
+		{Namespace: NamespaceArticle, URL: "a.html", Title: "Aardvark", MimeType: "text/html", Content: []byte("<html>a</html>")},
+		{Namespace: NamespaceArticle, URL: "b.html", Title: "Bobcat", MimeType: "text/html", Content: []byte("<html>b</html>")},
+	}
+	for _, a := range articles {
+		if err := w.Add(a); err != nil {
+			t.Fatalf("Add(%+v): %v", a, err)
+		}
+	}
+
+	dest := filepath.Join(t.TempDir(), "out.zim")
+	if err := w.Write(dest); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if len(data) < headerSize {
+		t.Fatalf("output too short to contain a header: %d bytes", len(data))
+	}
+
+	if magic := binary.LittleEndian.Uint32(data[0:4]); magic != zimMagic {
+		t.Fatalf("magic = %#x, want %#x", magic, zimMagic)
+	}
+
+	entryCount := binary.LittleEndian.Uint32(data[24:28])
+	if int(entryCount) != len(articles) {
+		t.Fatalf("header entry count = %d, want %d", entryCount, len(articles))
+	}
+	clusterCount := binary.LittleEndian.Uint32(data[28:32])
+	urlPtrPos := binary.LittleEndian.Uint64(data[32:40])
+	titlePtrPos := binary.LittleEndian.Uint64(data[40:48])
+	clusterPtrPos := binary.LittleEndian.Uint64(data[48:56])
+	mimeListPos := binary.LittleEndian.Uint64(data[56:64])
+	checksumPos := binary.LittleEndian.Uint64(data[72:80])
+
+	// The title pointer list must cover every entry (all namespaces), not
+	// just NamespaceArticle ones, or every offset after it desyncs.
+	titleCount := (clusterPtrPos - titlePtrPos) / 4
+	if titleCount != uint64(entryCount) {
+		t.Fatalf("title pointer list has %d entries, want %d (one per dirent)", titleCount, entryCount)
+	}
+
+	urlPtrSize := uint64(8 * entryCount)
+	if titlePtrPos != urlPtrPos+urlPtrSize {
+		t.Fatalf("titlePtrPos = %d, want %d (urlPtrPos + 8*entryCount)", titlePtrPos, urlPtrPos+urlPtrSize)
+	}
+
+	direntOffsets := make([]uint64, entryCount)
+	for i := range direntOffsets {
+		direntOffsets[i] = binary.LittleEndian.Uint64(data[urlPtrPos+uint64(i)*8:])
+	}
+
+	mimeTypes := parseMimeList(data[mimeListPos:])
+
+	dirents := make([]parsedDirent, entryCount)
+	for i, off := range direntOffsets {
+		dirents[i] = parseDirent(data[off:])
+	}
+
+	clusterOffsets := make([]uint64, clusterCount)
+	for i := range clusterOffsets {
+		clusterOffsets[i] = binary.LittleEndian.Uint64(data[clusterPtrPos+uint64(i)*8:])
+	}
+	clusterEnd := func(i int) uint64 {
+		if i+1 < len(clusterOffsets) {
+			return clusterOffsets[i+1]
+		}
+		return checksumPos
+	}
+	clusterBlobs := make([][][]byte, clusterCount)
+	for i := range clusterBlobs {
+		clusterBlobs[i] = decompressCluster(data[clusterOffsets[i]:clusterEnd(i)])
+	}
+
+	want := make(map[string]Article, len(articles))
+	for _, a := range articles {
+		want[a.URL] = a
+	}
+
+	for _, d := range dirents {
+		a, ok := want[d.url]
+		if !ok {
+			t.Errorf("dirent for unexpected URL %q", d.url)
+			continue
+		}
+		if d.namespace != a.Namespace {
+			t.Errorf("%s: namespace = %q, want %q", d.url, d.namespace, a.Namespace)
+		}
+		if mimeTypes[d.mimeType] != a.MimeType {
+			t.Errorf("%s: mimeType = %q, want %q", d.url, mimeTypes[d.mimeType], a.MimeType)
+		}
+		if int(d.cluster) >= len(clusterBlobs) || int(d.blob) >= len(clusterBlobs[d.cluster]) {
+			t.Errorf("%s: cluster/blob index %d/%d out of range", d.url, d.cluster, d.blob)
+			continue
+		}
+		got := clusterBlobs[d.cluster][d.blob]
+		if !bytes.Equal(got, a.Content) {
+			t.Errorf("%s: content = %q, want %q", d.url, got, a.Content)
+		}
+		delete(want, d.url)
+	}
+	if len(want) > 0 {
+		t.Errorf("articles missing from output: %v", want)
+	}
+}
+
+func TestTitlePointerOrderCoversAllNamespaces(t *testing.T) {
+	articles := []Article{
+		{Namespace: NamespaceAsset, URL: "style.css", Title: "", Content: []byte("x")},
+		{Namespace: NamespaceArticle, URL: "a.html", Title: "Zed", Content: []byte("x")},
+		{Namespace: NamespaceArticle, URL: "b.html", Title: "Anna", Content: []byte("x")},
+	}
+	idx := titlePointerOrder(articles)
+	if len(idx) != len(articles) {
+		t.Fatalf("titlePointerOrder returned %d entries, want %d (one per article, all namespaces)", len(idx), len(articles))
+	}
+	for i := 1; i < len(idx); i++ {
+		if articleTitle(articles[idx[i-1]]) > articleTitle(articles[idx[i]]) {
+			t.Fatalf("titlePointerOrder not sorted by title: %v", idx)
+		}
+	}
+}